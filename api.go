@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+// AdminAPI extends the existing :8799 HTTP server into a small operator
+// surface: status, on-demand rotation, dry-run rendering and the upcoming
+// key schedule. Mutating endpoints require a bearer JWT signed with Secret.
+type AdminAPI struct {
+	Server *KeyServer
+	Log    *zap.Logger
+	Secret []byte
+}
+
+// NewAdminAPI returns an AdminAPI for server, verifying bearer tokens on
+// mutating endpoints against secret.
+func NewAdminAPI(server *KeyServer, log *zap.Logger, secret string) *AdminAPI {
+	return &AdminAPI{Server: server, Log: log, Secret: []byte(secret)}
+}
+
+// Register adds the admin API's routes to mux.
+func (a *AdminAPI) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/status", a.handleStatus)
+	mux.HandleFunc("/rotate", a.requireAuth(a.handleRotate))
+	mux.HandleFunc("/dryrun", a.requireAuth(a.handleDryRun))
+	mux.HandleFunc("/keys/preview", a.handleKeysPreview)
+	mux.HandleFunc("/audit", a.handleAudit)
+}
+
+// requireAuth wraps next so it only runs once the request carries a bearer
+// token that's a validly-signed, unexpired HS256 JWT for a.Secret.
+func (a *AdminAPI) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(a.Secret) == 0 {
+			http.Error(w, "admin API secret not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || tokenString == "" {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+			}
+			return a.Secret, nil
+		}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithExpirationRequired())
+		if err != nil || !token.Valid {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (a *AdminAPI) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.Server.DeviceStatuses(r.Context()))
+}
+
+// handleRotate forces an immediate loop() run outside the daemon's 24h
+// sleep, e.g. during a maintenance window. loop() itself rejects overlapping
+// runs, so a rotation already in flight (scheduled or on-demand) surfaces
+// here as 409 rather than interleaving with this one.
+func (a *AdminAPI) handleRotate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := a.Server.loop(r.Context(), a.Log); err != nil {
+		if errors.Is(err, ErrRotationInProgress) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+}
+
+// handleDryRun runs Generate against a scratch KeyServer (so it doesn't
+// disturb s.Template) and returns, per driver, the commands that would be
+// pushed to that vendor's devices, without pushing them.
+func (a *AdminAPI) handleDryRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scratch := &KeyServer{Config: a.Server.Config, Template: Template{CAK: []string{}, CKN: []string{}, ROLL: []string{}}}
+	if err := scratch.Generate(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	commands := make(map[string][]string, len(a.Server.Drivers))
+	for name, driver := range a.Server.Drivers {
+		cmds, err := driver.Render(scratch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		commands[name] = cmds
+	}
+
+	writeJSON(w, http.StatusOK, map[string]map[string][]string{"commands": commands})
+}
+
+// handleKeysPreview shows the upcoming CKN/ROLL schedule. CAK (the actual
+// key secret) is intentionally never returned here.
+func (a *AdminAPI) handleKeysPreview(w http.ResponseWriter, r *http.Request) {
+	scratch := &KeyServer{Config: a.Server.Config, Template: Template{CAK: []string{}, CKN: []string{}, ROLL: []string{}}}
+	if err := scratch.Generate(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		CKN  []string `json:"ckn"`
+		ROLL []string `json:"roll"`
+	}{scratch.Template.CKN, scratch.Template.ROLL})
+}
+
+// AuditEntry is one rotation's entry in the admin API's /audit response. CAK
+// is intentionally omitted since it's the actual key secret.
+type AuditEntry struct {
+	ID          int64           `json:"id"`
+	GeneratedAt time.Time       `json:"generated_at"`
+	ActivateAt  time.Time       `json:"activate_at"`
+	Keychain    string          `json:"keychain"`
+	CKN         []string        `json:"ckn"`
+	Devices     []string        `json:"devices"`
+	Outcomes    []DeviceOutcome `json:"outcomes"`
+}
+
+// handleAudit returns the most recent rotations and their per-device commit
+// outcomes. limit is taken from the ?limit= query parameter, defaulting to
+// 50.
+func (a *AdminAPI) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if a.Server.Store == nil {
+		http.Error(w, "audit store not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	limit := 50
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			limit = n
+		}
+	}
+
+	rotations, outcomes, err := a.Server.Store.Rotations(r.Context(), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]AuditEntry, len(rotations))
+	for i, rotation := range rotations {
+		entries[i] = AuditEntry{
+			ID:          rotation.ID,
+			GeneratedAt: rotation.GeneratedAt,
+			ActivateAt:  rotation.ActivateAt,
+			Keychain:    rotation.Keychain,
+			CKN:         rotation.CKN,
+			Devices:     rotation.Devices,
+			Outcomes:    outcomes[rotation.ID],
+		}
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Credentials is the resolved SSH identity for a single device session.
+// Exactly one of KeyPath or KeyPEM is set: KeyPath points at key material
+// already on disk, KeyPEM carries it in memory (from Vault or the
+// environment). go-junos only accepts a path, so JunosDriver materializes
+// KeyPEM to a file (see keyPath); IOSXRDriver parses it in memory into a
+// golang.org/x/crypto/ssh signer. Certificate, if set, is an OpenSSH-signed certificate for KeyPEM's
+// public half, used in place of the bare key where the driver supports it.
+type Credentials struct {
+	Username    string
+	KeyPath     string
+	KeyPEM      []byte
+	Certificate []byte
+}
+
+// keyPath returns a filesystem path to the private key, materializing KeyPEM
+// to a private temp file if it wasn't already on disk. The caller must run
+// the returned cleanup once the session using it is open.
+func (c Credentials) keyPath() (path string, cleanup func(), err error) {
+	if c.KeyPath != "" {
+		return c.KeyPath, func() {}, nil
+	}
+	return materializeKey(c.KeyPEM)
+}
+
+// materializeKey writes PEM key material to a private, 0600 temp file for
+// libraries that only accept a path, returning a cleanup the caller must run
+// once the session open on that key no longer needs the file.
+func materializeKey(key []byte) (path string, cleanup func(), err error) {
+	f, err := os.CreateTemp("", "keyserver-key-*")
+	if err != nil {
+		return "", nil, err
+	}
+	name := f.Name()
+	cleanup = func() { os.Remove(name) }
+
+	if err := f.Chmod(0o600); err != nil {
+		f.Close()
+		cleanup()
+		return "", nil, err
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		cleanup()
+		return "", nil, err
+	}
+	if err := f.Close(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return name, cleanup, nil
+}
+
+// CredentialProvider resolves the SSH identity to use for a device session.
+// KeyServer resolves through it on every loop rather than caching the
+// result, so a rotated Vault lease or an edited key file is honored without
+// restarting the daemon.
+type CredentialProvider interface {
+	Resolve(ctx context.Context) (Credentials, error)
+}
+
+// FileProvider reads the username from config and points at a private key
+// already on disk: the keyserver's original, and still default, behavior.
+type FileProvider struct {
+	Username string
+	KeyPath  string
+}
+
+// NewFileProvider returns a CredentialProvider backed by a key file on disk.
+func NewFileProvider(username, keyPath string) *FileProvider {
+	return &FileProvider{Username: username, KeyPath: keyPath}
+}
+
+func (p *FileProvider) Resolve(ctx context.Context) (Credentials, error) {
+	if p.KeyPath == "" {
+		return Credentials{}, fmt.Errorf("file credential provider: no key path configured")
+	}
+	return Credentials{Username: p.Username, KeyPath: p.KeyPath}, nil
+}
+
+// EnvProvider reads the username and a PEM-encoded private key from
+// environment variables, so neither touches disk or config.json.
+type EnvProvider struct {
+	UsernameVar string
+	KeyVar      string
+}
+
+// NewEnvProvider returns a CredentialProvider backed by the environment
+// variables named usernameVar and keyVar.
+func NewEnvProvider(usernameVar, keyVar string) *EnvProvider {
+	return &EnvProvider{UsernameVar: usernameVar, KeyVar: keyVar}
+}
+
+func (p *EnvProvider) Resolve(ctx context.Context) (Credentials, error) {
+	username, ok := os.LookupEnv(p.UsernameVar)
+	if !ok {
+		return Credentials{}, fmt.Errorf("env credential provider: %s not set", p.UsernameVar)
+	}
+	key, ok := os.LookupEnv(p.KeyVar)
+	if !ok {
+		return Credentials{}, fmt.Errorf("env credential provider: %s not set", p.KeyVar)
+	}
+	return Credentials{Username: username, KeyPEM: []byte(key)}, nil
+}
+
+var (
+	_ CredentialProvider = (*FileProvider)(nil)
+	_ CredentialProvider = (*EnvProvider)(nil)
+)
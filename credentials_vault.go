@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"golang.org/x/crypto/ssh"
+)
+
+// VaultProvider resolves SSH credentials from HashiCorp Vault's KV v2
+// engine, optionally signing a short-lived certificate through the ssh
+// secrets engine instead of shipping a long-lived private key on disk.
+type VaultProvider struct {
+	Path string
+	Role string
+
+	client *vaultapi.Client
+}
+
+// NewVaultProvider builds a VaultProvider talking to the Vault server at
+// address, reading the KV v2 secret at path and, if role is non-empty,
+// signing a certificate under that ssh secrets engine role on every
+// Resolve so expired certificates are refreshed without a restart.
+func NewVaultProvider(address, path, role string) (*VaultProvider, error) {
+	cfg := vaultapi.DefaultConfig()
+	cfg.Address = address
+	client, err := vaultapi.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("vault: building client: %w", err)
+	}
+	return &VaultProvider{Path: path, Role: role, client: client}, nil
+}
+
+func (p *VaultProvider) Resolve(ctx context.Context) (Credentials, error) {
+	secret, err := p.client.Logical().ReadWithContext(ctx, p.Path)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("vault: reading %s: %w", p.Path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return Credentials{}, fmt.Errorf("vault: no secret found at %s", p.Path)
+	}
+
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return Credentials{}, fmt.Errorf("vault: %s is not a KV v2 secret", p.Path)
+	}
+
+	username, _ := data["username"].(string)
+	privateKey, _ := data["private_key"].(string)
+	if username == "" || privateKey == "" {
+		return Credentials{}, fmt.Errorf("vault: secret at %s missing username or private_key", p.Path)
+	}
+
+	creds := Credentials{Username: username, KeyPEM: []byte(privateKey)}
+
+	if p.Role != "" {
+		if err := p.sign(ctx, &creds); err != nil {
+			return Credentials{}, err
+		}
+	}
+
+	return creds, nil
+}
+
+// sign requests a short-lived certificate for creds' public key from
+// Vault's ssh secrets engine, so the private key only needs to be trusted
+// for as long as the certificate is valid.
+func (p *VaultProvider) sign(ctx context.Context, creds *Credentials) error {
+	signer, err := ssh.ParsePrivateKey(creds.KeyPEM)
+	if err != nil {
+		return fmt.Errorf("vault: parsing private key before signing: %w", err)
+	}
+	publicKey := string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+
+	secret, err := p.client.Logical().WriteWithContext(ctx, fmt.Sprintf("ssh/sign/%s", p.Role), map[string]interface{}{
+		"public_key": publicKey,
+	})
+	if err != nil {
+		return fmt.Errorf("vault: signing certificate under role %s: %w", p.Role, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return fmt.Errorf("vault: ssh secrets engine returned no certificate for role %s", p.Role)
+	}
+
+	cert, _ := secret.Data["signed_key"].(string)
+	if cert == "" {
+		return fmt.Errorf("vault: ssh secrets engine response missing signed_key")
+	}
+	creds.Certificate = []byte(cert)
+
+	return nil
+}
+
+var _ CredentialProvider = (*VaultProvider)(nil)
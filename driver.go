@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// KeychainState is the vendor-neutral view of a device's hitless key chain
+// (MACsec/hashed authentication key chain) as reported by FetchStatus.
+type KeychainState struct {
+	ActiveSendKey    int
+	ActiveReceiveKey int
+	NextSendKey      string
+	NextReceiveKey   string
+	NextKeyTime      string
+}
+
+// Ready reports whether the device has no key scheduled to roll in and is
+// therefore eligible to receive a newly generated one.
+func (s KeychainState) Ready() bool {
+	return s.NextSendKey == "None" && s.NextReceiveKey == "None" && s.NextKeyTime == "None"
+}
+
+// Device identifies a single managed router and the driver used to reach it,
+// so a single KeyServer can roll keys across a mixed-vendor fleet.
+type Device struct {
+	Name   string `json:"name"`
+	Driver string `json:"driver"`
+}
+
+// KeychainDriver abstracts the vendor-specific mechanics of reading and
+// rolling a device's key chain so KeyServer.loop can stay vendor-agnostic.
+//
+// Pushing a new key chain is a two-phase confirmed commit: LoadCandidate and
+// ConfirmedCommit run against every device before any of them is made
+// permanent, and ConfirmCommit is only issued once all devices have
+// acknowledged the confirmed commit. A device that never receives the
+// confirming commit (crash, network partition) auto-reverts when its
+// confirm timer expires, so a partial rollout can't wedge the fleet.
+//
+// ctx carries loop's per-run deadline (Config.LoopTimeout), but whether a
+// driver can actually enforce it depends on what its transport exposes:
+// IOSXRDriver derives an SSH connect timeout from it, while JunosDriver's
+// underlying library has no timeout or cancellation hook at all, so a
+// wedged Junos device can still block past the deadline.
+type KeychainDriver interface {
+	FetchStatus(ctx context.Context, device Device) (KeychainState, error)
+
+	// Render converts s's current key schedule (Config.Keychain and
+	// Template) into this driver's vendor-specific configuration lines for
+	// LoadCandidate to push. Each driver uses its own template, since Junos
+	// set-style CLI and IOS-XR native CLI aren't interchangeable.
+	Render(s *KeyServer) ([]string, error)
+
+	LoadCandidate(ctx context.Context, device Device, cmds []string) error
+
+	// ConfirmedCommit takes a confirmed commit with a rollback timer of
+	// timeout. persistID identifies it to a later ConfirmCommit call that
+	// may run over a different connection/session; drivers whose confirmed
+	// commit isn't tied to the session that issued it (e.g. JunosDriver)
+	// ignore persistID.
+	ConfirmedCommit(ctx context.Context, device Device, timeout time.Duration, persistID string) error
+
+	// ConfirmCommit makes a prior ConfirmedCommit permanent, identified by
+	// persistID (see ConfirmedCommit).
+	ConfirmCommit(ctx context.Context, device Device, persistID string) error
+	Rollback(ctx context.Context, device Device) error
+	CheckTimeSource(ctx context.Context, device Device) error
+}
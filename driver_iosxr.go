@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Juniper/go-netconf/netconf"
+	"github.com/antchfx/xmlquery"
+	"golang.org/x/crypto/ssh"
+)
+
+// iosxrKeychainFilter requests the operational state of a single MACsec
+// keychain from the Cisco-IOS-XR-crypto-macsec-mka-oper YANG model.
+const iosxrKeychainFilter = `<get><filter type="subtree"><keychains xmlns="http://cisco.com/ns/yang/Cisco-IOS-XR-crypto-macsec-mka-oper"><keychain><keychain-name>%s</keychain-name></keychain></keychains></filter></get>`
+
+// iosxrEditConfig installs the candidate key chain configuration as a set
+// of native CLI lines wrapped in IOS-XR's NETCONF <load-configuration>-style
+// edit-config with a default operation of merge.
+const iosxrEditConfig = `<edit-config><target><candidate/></target><default-operation>merge</default-operation><config>%s</config></edit-config>`
+const iosxrCommit = `<commit/>`
+
+// iosxrCommitConfirmed sets a persist token on the confirmed commit (RFC
+// 6241 8.3.4.1) so the confirming commit isn't tied to the NETCONF session
+// that issued it — required here since LoadCandidate/ConfirmedCommit/
+// ConfirmCommit each dial their own session and close it when they return.
+// Without persist, the device would revert the moment ConfirmedCommit's
+// session closed, before ConfirmCommit's later, separate session ever ran.
+const iosxrCommitConfirmed = `<commit><confirmed/><confirm-timeout>%d</confirm-timeout><persist>%s</persist></commit>`
+const iosxrCommitPersisted = `<commit><persist-id>%s</persist-id></commit>`
+const iosxrDiscardChanges = `<discard-changes/>`
+
+// IOSXRDriver manages MACsec key chains on Cisco IOS-XR devices over plain
+// NETCONF/SSH, so mixed Juniper/Cisco fleets can share one KeyServer.
+type IOSXRDriver struct {
+	Credentials CredentialProvider
+	Keychain    string
+}
+
+// NewIOSXRDriver returns a KeychainDriver for IOS-XR devices authenticating
+// with the identity resolved from creds.
+func NewIOSXRDriver(creds CredentialProvider, keychain string) *IOSXRDriver {
+	return &IOSXRDriver{Credentials: creds, Keychain: keychain}
+}
+
+// clientConfig resolves creds for this session and, when Vault has signed a
+// certificate for them, authenticates with it instead of the bare key. The
+// returned config's Timeout is derived from ctx's deadline, if any, so a
+// loop deadline genuinely bounds how long DialSSH can block establishing the
+// TCP connection.
+func (d *IOSXRDriver) clientConfig(ctx context.Context) (*ssh.ClientConfig, error) {
+	creds, err := d.Credentials.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keyData := creds.KeyPEM
+	if creds.KeyPath != "" {
+		keyData, err = os.ReadFile(creds.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(creds.Certificate) > 0 {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(creds.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("parsing signed certificate: %w", err)
+		}
+		cert, ok := pub.(*ssh.Certificate)
+		if !ok {
+			return nil, fmt.Errorf("credential certificate is not an ssh.Certificate")
+		}
+		signer, err = ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			return nil, fmt.Errorf("building certificate signer: %w", err)
+		}
+	}
+
+	cfg := &ssh.ClientConfig{
+		User:            creds.Username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		cfg.Timeout = time.Until(deadline)
+	}
+	return cfg, nil
+}
+
+// dial fails fast if ctx has already expired, then connects with a TCP
+// connect timeout bound to ctx's deadline (see clientConfig). go-netconf's
+// DialSSH itself takes no context, and the timeout bounds only the TCP
+// connect, so once the SSH handshake is underway it can no longer be
+// cancelled or timed out.
+func (d *IOSXRDriver) dial(ctx context.Context, device Device) (*netconf.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	clientConfig, err := d.clientConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return netconf.DialSSH(device.Name+":830", clientConfig)
+}
+
+func (d *IOSXRDriver) CheckTimeSource(ctx context.Context, device Device) error {
+	sess, err := d.dial(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	reply, err := sess.Exec(netconf.RawMethod(`<get><filter type="subtree"><ntp xmlns="http://cisco.com/ns/yang/Cisco-IOS-XR-ntp-oper"/></filter></get>`))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(reply.Data, "<is-sys-peer>true</is-sys-peer>") {
+		return fmt.Errorf("router %s does not have NTP configured", device.Name)
+	}
+
+	return nil
+}
+
+func (d *IOSXRDriver) FetchStatus(ctx context.Context, device Device) (KeychainState, error) {
+	sess, err := d.dial(ctx, device)
+	if err != nil {
+		return KeychainState{}, err
+	}
+	defer sess.Close()
+
+	reply, err := sess.Exec(netconf.RawMethod(fmt.Sprintf(iosxrKeychainFilter, d.Keychain)))
+	if err != nil {
+		return KeychainState{}, fmt.Errorf("keychain get-config error on router %s", device.Name)
+	}
+
+	doc, err := xmlquery.Parse(strings.NewReader(reply.Data))
+	if err != nil {
+		return KeychainState{}, fmt.Errorf("keychain parsing error on router %s", device.Name)
+	}
+
+	keychain := xmlquery.FindOne(doc, "//keychain")
+	if keychain == nil {
+		return KeychainState{}, fmt.Errorf("couldn't get keychain information on router %s", device.Name)
+	}
+
+	activeSendKey := keychain.SelectElement("active-send-key-id")
+	activeReceiveKey := keychain.SelectElement("active-receive-key-id")
+	if activeSendKey == nil || activeReceiveKey == nil {
+		return KeychainState{}, fmt.Errorf("couldn't get active keys from router %s", device.Name)
+	}
+
+	ask := activeSendKey.InnerText()
+	ark := activeReceiveKey.InnerText()
+	if ask != ark {
+		return KeychainState{}, fmt.Errorf("differing send (%s) and receive (%s) keys on %s", ask, ark, device.Name)
+	}
+
+	askInt, err := strconv.Atoi(ask)
+	if err != nil {
+		return KeychainState{}, fmt.Errorf("string conversion error of %s on router %s", ask, device.Name)
+	}
+	arkInt, err := strconv.Atoi(ark)
+	if err != nil {
+		return KeychainState{}, fmt.Errorf("string conversion error of %s on router %s", ark, device.Name)
+	}
+
+	nextSendKey, nextReceiveKey, nextKeyTime := "None", "None", "None"
+	if next := keychain.SelectElement("next-send-key-id"); next != nil {
+		nextSendKey = next.InnerText()
+	}
+	if next := keychain.SelectElement("next-receive-key-id"); next != nil {
+		nextReceiveKey = next.InnerText()
+	}
+	if next := keychain.SelectElement("next-key-time"); next != nil {
+		nextKeyTime = next.InnerText()
+	}
+
+	return KeychainState{
+		ActiveSendKey:    askInt,
+		ActiveReceiveKey: arkInt,
+		NextSendKey:      nextSendKey,
+		NextReceiveKey:   nextReceiveKey,
+		NextKeyTime:      nextKeyTime,
+	}, nil
+}
+
+// Render renders keychain_iosxr.tmpl, producing the IOS-XR native "key
+// chain ... macsec" CLI for s's current key schedule, wrapped by
+// LoadCandidate into a <config-set> edit.
+func (d *IOSXRDriver) Render(s *KeyServer) ([]string, error) {
+	return renderTemplate("keychain_iosxr.tmpl", s)
+}
+
+// LoadCandidate merges cmds into the candidate datastore without committing
+// it.
+func (d *IOSXRDriver) LoadCandidate(ctx context.Context, device Device, cmds []string) error {
+	sess, err := d.dial(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	config := fmt.Sprintf("<config-set>%s</config-set>", strings.Join(cmds, "\n"))
+	_, err = sess.Exec(netconf.RawMethod(fmt.Sprintf(iosxrEditConfig, config)))
+	return err
+}
+
+// ConfirmedCommit issues IOS-XR's NETCONF <commit><confirmed/> RPC with a
+// confirm-timeout in seconds and persistID as its persist token, which
+// reverts the candidate datastore to the prior running configuration if
+// ConfirmCommit's persist-id commit never follows before timeout elapses.
+// persistID must be non-empty: it's what lets ConfirmCommit, dialing a
+// brand new session later, confirm this commit instead of the device
+// reverting as soon as this session closes.
+func (d *IOSXRDriver) ConfirmedCommit(ctx context.Context, device Device, timeout time.Duration, persistID string) error {
+	sess, err := d.dial(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	_, err = sess.Exec(netconf.RawMethod(fmt.Sprintf(iosxrCommitConfirmed, int(timeout.Seconds()), persistID)))
+	return err
+}
+
+// ConfirmCommit issues the commit that makes a prior confirmed commit
+// permanent, cancelling the device's rollback timer. It references
+// persistID so it can confirm a commit made by a different (and by now
+// closed) session, rather than needing to reuse ConfirmedCommit's session.
+func (d *IOSXRDriver) ConfirmCommit(ctx context.Context, device Device, persistID string) error {
+	sess, err := d.dial(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	method := iosxrCommit
+	if persistID != "" {
+		method = fmt.Sprintf(iosxrCommitPersisted, persistID)
+	}
+	_, err = sess.Exec(netconf.RawMethod(method))
+	return err
+}
+
+func (d *IOSXRDriver) Rollback(ctx context.Context, device Device) error {
+	sess, err := d.dial(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	_, err = sess.Exec(netconf.RawMethod(iosxrDiscardChanges))
+	return err
+}
+
+var _ KeychainDriver = (*IOSXRDriver)(nil)
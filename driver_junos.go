@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+	"github.com/scottdware/go-junos"
+)
+
+// JunosDriver manages hitless key chains on Juniper devices via the Junos
+// XML API (NETCONF-over-SSH), using the hakr-keychain operational hierarchy.
+type JunosDriver struct {
+	Credentials CredentialProvider
+	Keychain    string
+}
+
+// NewJunosDriver returns a KeychainDriver for Juniper devices authenticating
+// with the identity resolved from creds.
+func NewJunosDriver(creds CredentialProvider, keychain string) *JunosDriver {
+	return &JunosDriver{Credentials: creds, Keychain: keychain}
+}
+
+// session fails fast if ctx has already expired, then dials the device.
+// go-junos's NewSession/AuthMethod expose no context or dial timeout at
+// all, so once this call is underway a wedged device can still block past
+// ctx's deadline; the ctx.Err() check here only stops new sessions from
+// starting after the deadline has already passed.
+func (d *JunosDriver) session(ctx context.Context, device Device) (*junos.Junos, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	creds, err := d.Credentials.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keyPath, cleanup, err := creds.keyPath()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	auth := &junos.AuthMethod{
+		Username:   creds.Username,
+		PrivateKey: keyPath,
+	}
+	return junos.NewSession(device.Name+":22", auth)
+}
+
+func (d *JunosDriver) CheckTimeSource(ctx context.Context, device Device) error {
+	jnpr, err := d.session(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer jnpr.Close()
+
+	output, err := jnpr.Command("show system uptime", "xml")
+	if err != nil {
+		return err
+	}
+	doc, err := xmlquery.Parse(strings.NewReader(output))
+	if err != nil {
+		return err
+	}
+
+	uptimeInformation := xmlquery.FindOne(doc, "//system-uptime-information")
+	if ntp := uptimeInformation.SelectElement("time-source"); ntp != nil {
+		if !strings.Contains(ntp.InnerText(), "NTP") {
+			return fmt.Errorf("router %s does not have NTP configured", device.Name)
+		}
+	}
+
+	return nil
+}
+
+func (d *JunosDriver) FetchStatus(ctx context.Context, device Device) (KeychainState, error) {
+	jnpr, err := d.session(ctx, device)
+	if err != nil {
+		return KeychainState{}, err
+	}
+	defer jnpr.Close()
+
+	keychainOutput, err := jnpr.Command("show security keychain", "xml")
+	if err != nil {
+		return KeychainState{}, fmt.Errorf("keychain op command error on router %s", device.Name)
+	}
+	doc, err := xmlquery.Parse(strings.NewReader(keychainOutput))
+	if err != nil {
+		return KeychainState{}, fmt.Errorf("keychain parsing error on router %s", device.Name)
+	}
+
+	hakrKeychain := fmt.Sprintf("//hakr-keychain[hakr-keychain-name='%s']", d.Keychain)
+	hakrInformation := xmlquery.FindOne(doc, hakrKeychain)
+	if hakrInformation == nil {
+		return KeychainState{}, fmt.Errorf("couldn't get keychain information on router %s", device.Name)
+	}
+
+	activeSendKey := hakrInformation.SelectElement("hakr-keychain-active-send-key")
+	if activeSendKey == nil {
+		return KeychainState{}, fmt.Errorf("couldn't get active send key from router %s", device.Name)
+	}
+	activeReceiveKey := hakrInformation.SelectElement("hakr-keychain-active-receive-key")
+	if activeReceiveKey == nil {
+		return KeychainState{}, fmt.Errorf("couldn't get active receive key from router %s", device.Name)
+	}
+	nextSendKey := hakrInformation.SelectElement("hakr-keychain-next-send-key")
+	if nextSendKey == nil {
+		return KeychainState{}, fmt.Errorf("couldn't get next send key from router %s", device.Name)
+	}
+	nextReceiveKey := hakrInformation.SelectElement("hakr-keychain-next-receive-key")
+	if nextReceiveKey == nil {
+		return KeychainState{}, fmt.Errorf("couldn't get next receive key from router %s", device.Name)
+	}
+	nextKeyTime := hakrInformation.SelectElement("hakr-keychain-next-key-time")
+	if nextKeyTime == nil {
+		return KeychainState{}, fmt.Errorf("couldn't get next key time from router %s", device.Name)
+	}
+
+	ask := activeSendKey.InnerText()
+	ark := activeReceiveKey.InnerText()
+	if ask != ark {
+		return KeychainState{}, fmt.Errorf("differing send (%s) and receive (%s) keys on %s", ask, ark, device.Name)
+	}
+
+	askInt, err := strconv.Atoi(ask)
+	if err != nil {
+		return KeychainState{}, fmt.Errorf("string conversion error of %s on router %s", ask, device.Name)
+	}
+	arkInt, err := strconv.Atoi(ark)
+	if err != nil {
+		return KeychainState{}, fmt.Errorf("string conversion error of %s on router %s", ark, device.Name)
+	}
+
+	return KeychainState{
+		ActiveSendKey:    askInt,
+		ActiveReceiveKey: arkInt,
+		NextSendKey:      nextSendKey.InnerText(),
+		NextReceiveKey:   nextReceiveKey.InnerText(),
+		NextKeyTime:      nextKeyTime.InnerText(),
+	}, nil
+}
+
+// Render renders keychain.tmpl, producing the Junos "set security
+// authentication-key-chains ..." CLI lines for s's current key schedule.
+func (d *JunosDriver) Render(s *KeyServer) ([]string, error) {
+	return renderTemplate("keychain.tmpl", s)
+}
+
+// junosOK treats the XML-API's success reply, which doesn't unmarshal into
+// the commit-results struct go-junos expects, as a non-error.
+func junosOK(err error) error {
+	if err != nil && err.Error() == "expected element type <commit-results> but have <ok>" {
+		return nil
+	}
+	return err
+}
+
+// LoadCandidate loads cmds into the candidate configuration without
+// committing them.
+func (d *JunosDriver) LoadCandidate(ctx context.Context, device Device, cmds []string) error {
+	jnpr, err := d.session(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer jnpr.Close()
+
+	if err := junosOK(jnpr.CommitCheck()); err != nil {
+		return err
+	}
+
+	return junosOK(jnpr.Config(cmds, "set", false))
+}
+
+// ConfirmedCommit issues Junos's "commit confirmed <minutes>", which
+// schedules an automatic rollback to the prior active configuration if the
+// plain commit from ConfirmCommit never arrives before timeout. go-junos's
+// CommitConfirm takes whole minutes, so timeout is rounded down. Unlike
+// IOS-XR's NETCONF confirmed commit, Junos's rollback timer isn't tied to
+// the CLI session that started it, so persistID is unused here.
+func (d *JunosDriver) ConfirmedCommit(ctx context.Context, device Device, timeout time.Duration, persistID string) error {
+	jnpr, err := d.session(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer jnpr.Close()
+
+	return junosOK(jnpr.CommitConfirm(int(timeout.Minutes())))
+}
+
+// ConfirmCommit issues the plain commit that makes a prior confirmed commit
+// permanent, cancelling the device's rollback timer. persistID is unused
+// (see ConfirmedCommit).
+func (d *JunosDriver) ConfirmCommit(ctx context.Context, device Device, persistID string) error {
+	jnpr, err := d.session(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer jnpr.Close()
+
+	return junosOK(jnpr.Commit())
+}
+
+func (d *JunosDriver) Rollback(ctx context.Context, device Device) error {
+	jnpr, err := d.session(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer jnpr.Close()
+
+	return junosOK(jnpr.Rollback(1))
+}
+
+var _ KeychainDriver = (*JunosDriver)(nil)
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// StateEncryptor encrypts key material before a StateStore writes it and
+// decrypts it on the way back out, so a stolen audit database doesn't leak
+// live CAKs.
+type StateEncryptor interface {
+	Encrypt(ctx context.Context, plaintext string) (string, error)
+	Decrypt(ctx context.Context, ciphertext string) (string, error)
+}
+
+// PassphraseEncryptor derives its AES-256-GCM key from a configured
+// passphrase.
+type PassphraseEncryptor struct {
+	key []byte
+}
+
+// NewPassphraseEncryptor returns a StateEncryptor keyed on sha256(passphrase).
+func NewPassphraseEncryptor(passphrase string) *PassphraseEncryptor {
+	key := sha256.Sum256([]byte(passphrase))
+	return &PassphraseEncryptor{key: key[:]}
+}
+
+func (e *PassphraseEncryptor) Encrypt(ctx context.Context, plaintext string) (string, error) {
+	return encryptAESGCM(e.key, plaintext)
+}
+
+func (e *PassphraseEncryptor) Decrypt(ctx context.Context, ciphertext string) (string, error) {
+	return decryptAESGCM(e.key, ciphertext)
+}
+
+var _ StateEncryptor = (*PassphraseEncryptor)(nil)
+
+// CredentialEncryptor derives its AES-256-GCM key once, at construction
+// time, from the resolved credential's private key material. The key is
+// fixed for the life of the process: if it were instead re-resolved on
+// every Encrypt/Decrypt call, a rotated Vault lease would change the key out
+// from under already-written ciphertext and make every prior CAK
+// permanently undecryptable.
+type CredentialEncryptor struct {
+	key []byte
+}
+
+// NewCredentialEncryptor resolves creds once and returns a StateEncryptor
+// keyed on the result. Callers that need encryption to survive credential
+// rotation across restarts should set Config.Audit.Passphrase instead.
+func NewCredentialEncryptor(ctx context.Context, creds CredentialProvider) (*CredentialEncryptor, error) {
+	resolved, err := creds.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keyMaterial := resolved.KeyPEM
+	if resolved.KeyPath != "" {
+		keyMaterial, err = os.ReadFile(resolved.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sum := sha256.Sum256(keyMaterial)
+	return &CredentialEncryptor{key: sum[:]}, nil
+}
+
+func (e *CredentialEncryptor) Encrypt(ctx context.Context, plaintext string) (string, error) {
+	return encryptAESGCM(e.key, plaintext)
+}
+
+func (e *CredentialEncryptor) Decrypt(ctx context.Context, ciphertext string) (string, error) {
+	return decryptAESGCM(e.key, ciphertext)
+}
+
+var _ StateEncryptor = (*CredentialEncryptor)(nil)
+
+func encryptAESGCM(key []byte, plaintext string) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return hex.EncodeToString(sealed), nil
+}
+
+func decryptAESGCM(key []byte, ciphertext string) (string, error) {
+	data, err := hex.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("ciphertext shorter than nonce")
+	}
+	nonce, sealed := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DeviceError pairs a failure with the device it occurred on.
+type DeviceError struct {
+	Device string
+	Err    error
+}
+
+func (e *DeviceError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Device, e.Err)
+}
+
+func (e *DeviceError) Unwrap() error {
+	return e.Err
+}
+
+// MultiDeviceError aggregates the failures from a fleet-wide operation run
+// concurrently across devices, so callers can see every device that failed
+// rather than just the first one the worker pool happened to report.
+type MultiDeviceError struct {
+	Errors []*DeviceError
+}
+
+func (e *MultiDeviceError) Error() string {
+	parts := make([]string, len(e.Errors))
+	for i, de := range e.Errors {
+		parts[i] = de.Error()
+	}
+	return fmt.Sprintf("%d device(s) failed: %s", len(e.Errors), strings.Join(parts, "; "))
+}
+
+func (e *MultiDeviceError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, de := range e.Errors {
+		errs[i] = de
+	}
+	return errs
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"embed"
 	"encoding/hex"
@@ -11,23 +12,23 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
 
-	"github.com/antchfx/xmlquery"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/scottdware/go-junos"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
-	renderedTemplate bytes.Buffer
-	configCommands   []string
-	//go:embed keychain.tmpl
+	//go:embed *.tmpl
 	embedTemplate embed.FS
 	lastResult    = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "keyserver_result",
@@ -41,22 +42,223 @@ type Config struct {
 	Interval int      `json:"interval"`
 	Keychain string   `json:"keychain"`
 	NTP      bool     `json:"ntp"`
-	Devices  []string `json:"devices"`
+	Devices  []Device `json:"devices"`
+
+	// ConfirmTimeout is how long, in seconds, a device will wait for the
+	// confirming commit before auto-reverting. Defaults to 120.
+	ConfirmTimeout int `json:"confirm_timeout"`
+
+	// Credentials selects where device SSH credentials come from. If unset,
+	// it falls back to the User/Key fields above (a key file on disk).
+	Credentials CredentialsConfig `json:"credentials"`
+
+	// API configures the admin HTTP API.
+	API APIConfig `json:"api"`
+
+	// MaxConcurrency caps how many devices are operated on at once. Defaults
+	// to 4.
+	MaxConcurrency int `json:"max_concurrency"`
+
+	// LoopTimeout bounds, in seconds, a single loop run (status poll,
+	// generate, push) so a wedged device can't block the fleet indefinitely.
+	// Defaults to 600 (10 minutes). Only honored by drivers whose underlying
+	// transport supports a deadline; see IOSXRDriver and JunosDriver.
+	LoopTimeout int `json:"loop_timeout"`
+
+	// Audit configures the persistent audit log and state store.
+	Audit AuditConfig `json:"audit"`
+}
+
+// AuditConfig configures the persistent audit log and state store.
+type AuditConfig struct {
+	// Driver selects the StateStore backend: "sqlite" (default) or
+	// "postgres".
+	Driver string `json:"driver,omitempty"`
+
+	// DSN is the SQLite file path or Postgres connection string. Defaults to
+	// "keyserver-audit.db" for SQLite.
+	DSN string `json:"dsn,omitempty"`
+
+	// Passphrase derives the AES key used to encrypt CAK values at rest. If
+	// empty, audit encryption instead uses the resolved device credential's
+	// key material.
+	Passphrase string `json:"passphrase,omitempty"`
+
+	// RetentionDays is how long rotations are kept before being pruned.
+	// Defaults to 90. A negative value disables pruning.
+	RetentionDays int `json:"retention_days,omitempty"`
+}
+
+// APIConfig configures the admin HTTP API served alongside /metrics.
+type APIConfig struct {
+	// Addr is the listen address for both /metrics and the admin API.
+	// Defaults to ":8799".
+	Addr string `json:"addr,omitempty"`
+
+	// Secret is the HS256 shared secret used to verify bearer tokens on
+	// mutating endpoints. Mutating endpoints are refused if it's empty.
+	Secret string `json:"secret,omitempty"`
+}
+
+// CredentialsConfig selects and configures a CredentialProvider. Type is one
+// of "file" (default), "env" or "vault".
+type CredentialsConfig struct {
+	Type string `json:"type"`
+
+	// Address, Path and Role configure the vault provider.
+	Address string `json:"address,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Role    string `json:"role,omitempty"`
+
+	// UsernameVar and KeyVar configure the env provider.
+	UsernameVar string `json:"username_var,omitempty"`
+	KeyVar      string `json:"key_var,omitempty"`
+}
+
+// defaultConfirmTimeout is used when Config.ConfirmTimeout is unset.
+const defaultConfirmTimeout = 120 * time.Second
+
+// confirmTimeout returns the configured confirm timeout, or the default.
+func (c Config) confirmTimeout() time.Duration {
+	if c.ConfirmTimeout <= 0 {
+		return defaultConfirmTimeout
+	}
+	return time.Duration(c.ConfirmTimeout) * time.Second
+}
+
+// defaultMaxConcurrency is used when Config.MaxConcurrency is unset.
+const defaultMaxConcurrency = 4
+
+// workerLimit returns the configured per-device concurrency limit, or the
+// default.
+func (c Config) workerLimit() int {
+	if c.MaxConcurrency <= 0 {
+		return defaultMaxConcurrency
+	}
+	return c.MaxConcurrency
+}
+
+// defaultLoopTimeout is used when Config.LoopTimeout is unset.
+const defaultLoopTimeout = 10 * time.Minute
+
+// loopTimeout returns the configured per-run deadline for loop, or the
+// default.
+func (c Config) loopTimeout() time.Duration {
+	if c.LoopTimeout <= 0 {
+		return defaultLoopTimeout
+	}
+	return time.Duration(c.LoopTimeout) * time.Second
+}
+
+// defaultAuditDSN is used when Config.Audit.DSN is unset for the sqlite
+// driver.
+const defaultAuditDSN = "keyserver-audit.db"
+
+// defaultRetentionDays is used when Config.Audit.RetentionDays is unset.
+const defaultRetentionDays = 90
+
+// retention returns the configured audit retention window, or the default.
+// A zero result means pruning is disabled.
+func (c Config) retention() time.Duration {
+	days := c.Audit.RetentionDays
+	if days == 0 {
+		days = defaultRetentionDays
+	}
+	if days < 0 {
+		return 0
+	}
+	return time.Duration(days) * 24 * time.Hour
 }
 
 type KeyServer struct {
 	UsedKey  int
 	Config   Config
 	Template Template
+	Drivers  map[string]KeychainDriver
+	Store    StateStore
+
+	// currentRotationID is the audit record ID for the most recently
+	// generated rotation, so updateKeychain can attach per-device outcomes
+	// to it.
+	currentRotationID int64
+
+	// rotating guards loop against running twice at once. Run's 24h ticker
+	// and the admin API's on-demand /rotate both call loop on the same
+	// KeyServer, and loop mutates Template/UsedKey/currentRotationID without
+	// any other synchronization, so two overlapping runs would interleave
+	// two rotations against the same fleet.
+	rotating atomic.Bool
 }
 
+// ErrRotationInProgress is returned by loop when another rotation (scheduled
+// or on-demand) is already running.
+var ErrRotationInProgress = errors.New("a rotation is already in progress")
+
 type Template struct {
 	CKN  []string
 	CAK  []string
 	ROLL []string
 }
 
-func NewKeyServer(config Config) *KeyServer {
+// defaultDriver is used for any Device that doesn't set a Driver, so existing
+// all-Junos fleet configs keep working unchanged.
+const defaultDriver = "junos"
+
+// newCredentialProvider builds the CredentialProvider selected by
+// config.Credentials, defaulting to a FileProvider over User/Key.
+func newCredentialProvider(config Config) (CredentialProvider, error) {
+	switch config.Credentials.Type {
+	case "", "file":
+		return NewFileProvider(config.User, config.Key), nil
+	case "env":
+		return NewEnvProvider(config.Credentials.UsernameVar, config.Credentials.KeyVar), nil
+	case "vault":
+		return NewVaultProvider(config.Credentials.Address, config.Credentials.Path, config.Credentials.Role)
+	default:
+		return nil, fmt.Errorf("unknown credentials type %q", config.Credentials.Type)
+	}
+}
+
+// newStateStore builds the StateStore selected by config.Audit, encrypting
+// CAK values with a passphrase-derived key if one is configured, or else
+// with a key derived once from creds at startup (see NewCredentialEncryptor).
+func newStateStore(ctx context.Context, config Config, creds CredentialProvider) (StateStore, error) {
+	var encryptor StateEncryptor
+	if config.Audit.Passphrase != "" {
+		encryptor = NewPassphraseEncryptor(config.Audit.Passphrase)
+	} else {
+		credentialEncryptor, err := NewCredentialEncryptor(ctx, creds)
+		if err != nil {
+			return nil, fmt.Errorf("deriving audit encryption key: %w", err)
+		}
+		encryptor = credentialEncryptor
+	}
+
+	switch config.Audit.Driver {
+	case "", "sqlite":
+		dsn := config.Audit.DSN
+		if dsn == "" {
+			dsn = defaultAuditDSN
+		}
+		return NewSQLiteStore(dsn, encryptor)
+	case "postgres":
+		return NewPostgresStore(config.Audit.DSN, encryptor)
+	default:
+		return nil, fmt.Errorf("unknown audit driver %q", config.Audit.Driver)
+	}
+}
+
+func NewKeyServer(ctx context.Context, config Config) (*KeyServer, error) {
+	creds, err := newCredentialProvider(config)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newStateStore(ctx, config, creds)
+	if err != nil {
+		return nil, err
+	}
+
 	return &KeyServer{
 		Config: config,
 		Template: Template{
@@ -64,10 +266,30 @@ func NewKeyServer(config Config) *KeyServer {
 			CKN:  []string{},
 			ROLL: []string{},
 		},
+		Drivers: map[string]KeychainDriver{
+			"junos": NewJunosDriver(creds, config.Keychain),
+			"iosxr": NewIOSXRDriver(creds, config.Keychain),
+		},
+		Store: store,
+	}, nil
+}
+
+func (s *KeyServer) driverFor(device Device) (KeychainDriver, error) {
+	name := device.Driver
+	if name == "" {
+		name = defaultDriver
+	}
+	driver, ok := s.Drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("no driver registered for %q (device %s)", name, device.Name)
 	}
+	return driver, nil
 }
 
-func (s *KeyServer) Generate() error {
+// rollTimeLayout is the format used for Template.ROLL entries.
+const rollTimeLayout = "2006-01-02.15:04:05"
+
+func (s *KeyServer) Generate(ctx context.Context) error {
 	bytes := make([]byte, 32)
 	for i := 0; i < 31; i++ {
 		if _, err := rand.Read(bytes); err != nil {
@@ -82,23 +304,212 @@ func (s *KeyServer) Generate() error {
 
 		initial := time.Now().Add(time.Hour * time.Duration(s.Config.Interval))
 		next := initial.Add((time.Hour * time.Duration(i)) * time.Duration(s.Config.Interval))
-		timeString := next.Format("2006-01-02.15:04:05")
+		timeString := next.Format(rollTimeLayout)
 		s.Template.ROLL = append(s.Template.ROLL, timeString)
 	}
+
+	if s.Store == nil {
+		return nil
+	}
+
+	activateAt, err := time.Parse(rollTimeLayout, s.Template.ROLL[0])
+	if err != nil {
+		return fmt.Errorf("parsing activation time: %w", err)
+	}
+
+	devices := make([]string, len(s.Config.Devices))
+	for i, device := range s.Config.Devices {
+		devices[i] = device.Name
+	}
+
+	id, err := s.Store.RecordRotation(ctx, RotationRecord{
+		GeneratedAt: time.Now(),
+		ActivateAt:  activateAt,
+		Keychain:    s.Config.Keychain,
+		CKN:         s.Template.CKN,
+		CAK:         s.Template.CAK,
+		ROLL:        s.Template.ROLL,
+		Devices:     devices,
+	})
+	if err != nil {
+		return fmt.Errorf("recording rotation: %w", err)
+	}
+	s.currentRotationID = id
+
+	return nil
+}
+
+// recordOutcome records a single device's commit result against the most
+// recently generated rotation. Store errors are logged rather than
+// propagated, since a failure to write the audit trail shouldn't abort an
+// otherwise successful (or already-failing) rollout.
+func (s *KeyServer) recordOutcome(ctx context.Context, device string, status Outcome, detail string, log *zap.Logger) {
+	if s.Store == nil {
+		return
+	}
+
+	if err := s.Store.RecordOutcome(ctx, DeviceOutcome{
+		RotationID: s.currentRotationID,
+		Device:     device,
+		Status:     status,
+		Detail:     detail,
+		RecordedAt: time.Now(),
+	}); err != nil {
+		log.Error("audit record failed", zap.String("router", device), zap.Error(err))
+	}
+}
+
+// pruneAudit deletes rotations older than the configured retention window.
+func (s *KeyServer) pruneAudit(ctx context.Context, log *zap.Logger) error {
+	if s.Store == nil {
+		return nil
+	}
+	retention := s.Config.retention()
+	if retention <= 0 {
+		return nil
+	}
+	return s.Store.Prune(ctx, time.Now().Add(-retention))
+}
+
+// lastRotationStatus returns the most recently recorded rotation and which
+// of its target devices have a recorded committed outcome. It returns a nil
+// record if there's no audit store configured or no rotation has been
+// recorded yet.
+func (s *KeyServer) lastRotationStatus(ctx context.Context) (*RotationRecord, map[string]bool, error) {
+	if s.Store == nil {
+		return nil, nil, nil
+	}
+
+	rotations, outcomes, err := s.Store.Rotations(ctx, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rotations) == 0 {
+		return nil, nil, nil
+	}
+	last := rotations[0]
+
+	committed := make(map[string]bool)
+	for _, outcome := range outcomes[last.ID] {
+		if outcome.Status == OutcomeCommitted {
+			committed[outcome.Device] = true
+		}
+	}
+	return &last, committed, nil
+}
+
+// pendingRotation returns the last recorded rotation if any of its target
+// devices has no recorded committed outcome, so loop can resume pushing that
+// same schedule instead of generating and pushing a brand new one on top of
+// an unresolved rollout. It returns a nil record if the last rotation was
+// fully committed, or none has been recorded yet. It returns an error —
+// never a nil record standing in for "nothing pending" — if the rotation
+// that needs resuming has a CAK the store couldn't decrypt, since the caller
+// must not fall back to silently generating a new rotation on top of one it
+// can't tell is actually resolved.
+func (s *KeyServer) pendingRotation(ctx context.Context) (*RotationRecord, error) {
+	last, committed, err := s.lastRotationStatus(ctx)
+	if err != nil || last == nil {
+		return nil, err
+	}
+
+	for _, device := range last.Devices {
+		if !committed[device] {
+			if len(last.CAK) != len(last.CKN) {
+				return nil, fmt.Errorf("rotation %d has an unresolved device but its CAK couldn't be decrypted; refusing to resume or regenerate", last.ID)
+			}
+			return last, nil
+		}
+	}
+	return nil, nil
+}
+
+// Reconcile logs a diagnostic warning for any target device that has no
+// recorded committed outcome for the most recently generated rotation,
+// which can happen if the keyserver crashed mid-rollout. It's meant to be
+// called once at startup. The actual resume-instead-of-regenerate decision
+// is made by pendingRotation, which loop consults on every run.
+func (s *KeyServer) Reconcile(ctx context.Context, log *zap.Logger) error {
+	last, committed, err := s.lastRotationStatus(ctx)
+	if err != nil || last == nil {
+		return err
+	}
+
+	for _, device := range last.Devices {
+		if !committed[device] {
+			log.Warn("device has no recorded committed outcome for the last rotation",
+				zap.String("router", device), zap.Int64("rotation_id", last.ID))
+		}
+	}
+
 	return nil
 }
 
-func (s *KeyServer) Run(log *zap.Logger) {
+// renderTemplate renders the named embedded template (e.g. "keychain.tmpl"
+// for Junos or "keychain_iosxr.tmpl" for IOS-XR) against s's current
+// Template and returns the non-empty configuration lines it produced. Each
+// driver's Render method picks the template that matches its vendor syntax.
+func renderTemplate(name string, s *KeyServer) ([]string, error) {
+	funcMap := template.FuncMap{
+		"inc": func(i int) int {
+			return i + 1
+		},
+	}
+
+	t, err := template.New(name).Funcs(funcMap).ParseFS(embedTemplate, "*.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered bytes.Buffer
+	if err := t.Execute(&rendered, s); err != nil {
+		return nil, err
+	}
+
+	var cmds []string
+	for _, line := range strings.Split(rendered.String(), "\n") {
+		if len(line) > 1 {
+			cmds = append(cmds, line)
+		}
+	}
+	return cmds, nil
+}
+
+// Run drives the daemon loop until ctx is cancelled, e.g. by a SIGINT or
+// SIGTERM caught in main.
+func (s *KeyServer) Run(ctx context.Context, log *zap.Logger) {
 	for {
-		if err := s.loop(log); err != nil {
+		if err := s.loop(ctx, log); err != nil {
 			log.Error("loop error", zap.Error(err))
 		}
-		time.Sleep(time.Hour * 24)
+
+		select {
+		case <-ctx.Done():
+			log.Info("shutting down", zap.Error(ctx.Err()))
+			return
+		case <-time.After(time.Hour * 24):
+		}
 	}
 }
 
-func (s *KeyServer) loop(log *zap.Logger) error {
-	needsKey, usedKey, err := getKeychainStatus(s.Config)
+func (s *KeyServer) loop(ctx context.Context, log *zap.Logger) error {
+	if !s.rotating.CompareAndSwap(false, true) {
+		return ErrRotationInProgress
+	}
+	defer s.rotating.Store(false)
+
+	ctx, cancel := context.WithTimeout(ctx, s.Config.loopTimeout())
+	defer cancel()
+
+	start := time.Now()
+	defer func() { loopDuration.Observe(time.Since(start).Seconds()) }()
+	defer func() {
+		if err := s.pruneAudit(ctx, log); err != nil {
+			log.Error("audit prune failed", zap.Error(err))
+		}
+	}()
+
+	needsKey, usedKey, err := s.getKeychainStatus(ctx)
 	if err != nil {
 		log.Error("keychain error", zap.Error(err))
 		lastResult.Set(0.0)
@@ -113,41 +524,26 @@ func (s *KeyServer) loop(log *zap.Logger) error {
 
 	if needsKey {
 		s.UsedKey = usedKey[0]
-		if err := s.Generate(); err != nil {
-			log.Error("generation error", zap.Error(err))
-			lastResult.Set(0.5)
-			return err
-		}
 
-		funcMap := template.FuncMap{
-			"inc": func(i int) int {
-				return i + 1
-			},
-		}
-
-		t, err := template.New("keychain.tmpl").Funcs(funcMap).ParseFS(embedTemplate, "*.tmpl")
+		pending, err := s.pendingRotation(ctx)
 		if err != nil {
-			log.Error("template error", zap.Error(err))
+			log.Error("checking for a pending rotation failed", zap.Error(err))
 			lastResult.Set(0.5)
 			return err
 		}
 
-		executionErr := t.Execute(&renderedTemplate, s)
-		if executionErr != nil {
-			log.Error("template execution error", zap.Error(executionErr))
+		if pending != nil {
+			log.Warn("resuming unresolved rotation instead of generating a new one",
+				zap.Int64("rotation_id", pending.ID))
+			s.Template = Template{CKN: pending.CKN, CAK: pending.CAK, ROLL: pending.ROLL}
+			s.currentRotationID = pending.ID
+		} else if err := s.Generate(ctx); err != nil {
+			log.Error("generation error", zap.Error(err))
 			lastResult.Set(0.5)
 			return err
 		}
 
-		templateString := renderedTemplate.String()
-		rawCfgCommands := strings.Split(templateString, "\n")
-		for _, value := range rawCfgCommands {
-			if len(value) > 1 {
-				configCommands = append(configCommands, value)
-			}
-		}
-
-		if err := updateKeychain(s.Config, configCommands, log); err != nil {
+		if err := s.updateKeychain(ctx, log); err != nil {
 			log.Error("update keychain error", zap.Error(err))
 			lastResult.Set(0.0)
 			return err
@@ -188,26 +584,6 @@ func readConfig(file string, log *zap.Logger) (Config, error) {
 	return config, nil
 }
 
-func checkNTP(jnpr *junos.Junos) bool {
-	output, err := jnpr.Command("show system uptime", "xml")
-	if err != nil {
-		return false
-	}
-	doc, err := xmlquery.Parse(strings.NewReader(output))
-	if err != nil {
-		return false
-	}
-
-	uptimeInformation := xmlquery.FindOne(doc, "//system-uptime-information")
-	if ntp := uptimeInformation.SelectElement("time-source"); ntp != nil {
-		if !strings.Contains(ntp.InnerText(), "NTP") {
-			return false
-		}
-	}
-
-	return true
-}
-
 func checkIfSame(ActiveIDs []int) bool {
 	for i := 0; i < len(ActiveIDs); i++ {
 		if ActiveIDs[i] != ActiveIDs[0] {
@@ -217,104 +593,111 @@ func checkIfSame(ActiveIDs []int) bool {
 	return true
 }
 
-func getKeychainStatus(config Config) (bool, []int, error) {
-	var ActiveIDs []int
-	var readyForKeys []string
-
-	auth := &junos.AuthMethod{
-		Username:   config.User,
-		PrivateKey: config.Key,
-	}
-	for _, router := range config.Devices {
-		jnpr, err := junos.NewSession(router+":22", auth)
-		if err != nil {
-			return false, []int{}, err
-		}
-		defer jnpr.Close()
+// DeviceStatus is one device's entry in the admin API's /status response.
+type DeviceStatus struct {
+	Device   string        `json:"device"`
+	Driver   string        `json:"driver"`
+	State    KeychainState `json:"state,omitempty"`
+	NextRoll string        `json:"next_roll,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
 
-		if config.NTP {
-			ok := checkNTP(jnpr)
-			if !ok {
-				errMsg := fmt.Sprintf("ntp mandatory but router %s does not have it configured", router)
-				return false, []int{}, errors.New(errMsg)
-			}
-		}
+// DeviceStatuses fetches each device's keychain state independently, so one
+// unreachable router doesn't blank out the rest of the fleet's status.
+func (s *KeyServer) DeviceStatuses(ctx context.Context) []DeviceStatus {
+	statuses := make([]DeviceStatus, 0, len(s.Config.Devices))
+	for _, device := range s.Config.Devices {
+		status := DeviceStatus{Device: device.Name, Driver: device.Driver}
 
-		keychainOutput, err := jnpr.Command("show security keychain", "xml")
+		driver, err := s.driverFor(device)
 		if err != nil {
-			errMsg := fmt.Sprintf("keychain op command error on router %s", router)
-			return false, []int{}, errors.New(errMsg)
+			status.Error = err.Error()
+			statuses = append(statuses, status)
+			continue
 		}
-		doc, err := xmlquery.Parse(strings.NewReader(keychainOutput))
+
+		state, err := driver.FetchStatus(ctx, device)
 		if err != nil {
-			errMsg := fmt.Sprintf("keychain parsing error on router %s", router)
-			return false, []int{}, errors.New(errMsg)
+			status.Error = err.Error()
+		} else {
+			status.State = state
+			status.NextRoll = state.NextKeyTime
 		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
 
-		hakrKeychain := fmt.Sprintf("//hakr-keychain[hakr-keychain-name='%s']", config.Keychain)
-		hakrInformation := xmlquery.FindOne(doc, hakrKeychain)
+// getKeychainStatus polls every configured device through its driver,
+// concurrently over a bounded worker pool, and reports whether the fleet is
+// synchronized and due for a new key.
+func (s *KeyServer) getKeychainStatus(ctx context.Context) (bool, []int, error) {
+	devices := s.Config.Devices
+	states := make([]KeychainState, len(devices))
+
+	var mu sync.Mutex
+	var devErrs []*DeviceError
+	recordErr := func(device string, err error) {
+		mu.Lock()
+		devErrs = append(devErrs, &DeviceError{Device: device, Err: err})
+		mu.Unlock()
+	}
 
-		if hakrInformation == nil {
-			errMsg := fmt.Sprintf("couldn't get keychain information on router %s", router)
-			return false, []int{}, errors.New(errMsg)
-		}
-		activeSendKey := hakrInformation.SelectElement("hakr-keychain-active-send-key")
-		if activeSendKey == nil {
-			errMsg := fmt.Sprintf("couldn't get active send key from router %s", router)
-			return false, []int{}, errors.New(errMsg)
-		}
-		activeReceiveKey := hakrInformation.SelectElement("hakr-keychain-active-receive-key")
-		if activeReceiveKey == nil {
-			errMsg := fmt.Sprintf("couldn't get active receive key from router %s", router)
-			return false, []int{}, errors.New(errMsg)
-		}
-		nextSendKey := hakrInformation.SelectElement("hakr-keychain-next-send-key")
-		if nextSendKey == nil {
-			errMsg := fmt.Sprintf("couldn't get next send key from router %s", router)
-			return false, []int{}, errors.New(errMsg)
-		}
-		nextReceiveKey := hakrInformation.SelectElement("hakr-keychain-next-receive-key")
-		if nextReceiveKey == nil {
-			errMsg := fmt.Sprintf("couldn't get next receive key from router %s", router)
-			return false, []int{}, errors.New(errMsg)
-		}
-		nextKeyTime := hakrInformation.SelectElement("hakr-keychain-next-key-time")
-		if nextKeyTime == nil {
-			errMsg := fmt.Sprintf("couldn't get next key time from router %s", router)
-			return false, []int{}, errors.New(errMsg)
-		}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.Config.workerLimit())
+	for i, device := range devices {
+		i, device := i, device
+		g.Go(func() error {
+			driver, err := s.driverFor(device)
+			if err != nil {
+				recordErr(device.Name, err)
+				return err
+			}
 
-		ask := activeSendKey.InnerText()
-		ark := activeReceiveKey.InnerText()
-		nsk := nextSendKey.InnerText()
-		nrk := nextReceiveKey.InnerText()
-		nkt := nextKeyTime.InnerText()
+			if s.Config.NTP {
+				if err := driver.CheckTimeSource(gctx, device); err != nil {
+					deviceNTPOK.WithLabelValues(device.Name).Set(0)
+					recordErr(device.Name, err)
+					return err
+				}
+				deviceNTPOK.WithLabelValues(device.Name).Set(1)
+			}
 
-		if ask == ark {
-			askInt, err := strconv.Atoi(ask)
+			state, err := driver.FetchStatus(gctx, device)
 			if err != nil {
-				errMsg := fmt.Sprintf("string conversion error of %s on router %s", ask, router)
-				return false, []int{}, errors.New(errMsg)
-			}
-			if nsk == "None" && nrk == "None" && nkt == "None" {
-				ActiveIDs = append(ActiveIDs, askInt)
-				readyForKeys = append(readyForKeys, router)
-			} else {
-				ActiveIDs = append(ActiveIDs, askInt)
+				deviceUp.WithLabelValues(device.Name).Set(0)
+				recordErr(device.Name, err)
+				return err
 			}
-		} else {
-			errMsg := fmt.Sprintf("differing send (%s) and receive (%s) keys on %s", ask, nsk, router)
-			return false, []int{}, errors.New(errMsg)
+			deviceUp.WithLabelValues(device.Name).Set(1)
+			activeKeyID.WithLabelValues(device.Name, s.Config.Keychain).Set(float64(state.ActiveSendKey))
+			lastSuccessTimestamp.WithLabelValues(device.Name).SetToCurrentTime()
+
+			states[i] = state
+			return nil
+		})
+	}
+	g.Wait()
+
+	if len(devErrs) > 0 {
+		return false, []int{}, &MultiDeviceError{Errors: devErrs}
+	}
+
+	var ActiveIDs []int
+	var readyForKeys []string
+	for i, device := range devices {
+		ActiveIDs = append(ActiveIDs, states[i].ActiveSendKey)
+		if states[i].Ready() {
+			readyForKeys = append(readyForKeys, device.Name)
 		}
 	}
 
-	sameKeys := checkIfSame(ActiveIDs)
-	if !sameKeys {
+	if !checkIfSame(ActiveIDs) {
 		return false, []int{}, errors.New("keychains unsynchronized")
 	}
 
 	if len(readyForKeys) > 0 {
-		if len(config.Devices) != len(readyForKeys) {
+		if len(devices) != len(readyForKeys) {
 			return false, []int{}, errors.New("keychains unsynchronized")
 		}
 		return true, ActiveIDs, nil
@@ -322,76 +705,178 @@ func getKeychainStatus(config Config) (bool, []int, error) {
 	return false, ActiveIDs, nil
 }
 
-func updateKeychain(config Config, cmds []string, log *zap.Logger) error {
-	var committed []string
+// persistID returns the token ConfirmedCommit/ConfirmCommit use to tie a
+// confirmed commit to this rotation and device rather than to whatever
+// session happened to issue it, since phase one and phase two each dial
+// their own session. Deterministic from currentRotationID and the device
+// name, so phase two (a separate goroutine, possibly a retry) derives the
+// same token without needing it threaded through as extra state.
+func (s *KeyServer) persistID(device Device) string {
+	return fmt.Sprintf("keyserver-rotation-%d-%s", s.currentRotationID, device.Name)
+}
 
-	auth := &junos.AuthMethod{
-		Username:   config.User,
-		PrivateKey: config.Key,
+// updateKeychain rolls the current key schedule out to every device,
+// concurrently over a bounded worker pool, as a two-phase confirmed commit:
+// all devices load and confirm-commit the candidate before any of them
+// receives the confirming commit that makes it permanent. A device that
+// fails or never hears back auto-reverts via its own rollback timer, so a
+// crash mid-rollout can't leave the fleet half-migrated. Each device's
+// driver renders its own vendor-specific configuration from s.Template, so a
+// mixed fleet pushes Junos set-style commands to Junos devices and IOS-XR
+// native CLI to IOS-XR devices.
+func (s *KeyServer) updateKeychain(ctx context.Context, log *zap.Logger) error {
+	timeout := s.Config.confirmTimeout()
+	devices := s.Config.Devices
+
+	confirmed := make([]bool, len(devices))
+	var mu sync.Mutex
+	var phase1Errs []*DeviceError
+	recordErr := func(errs *[]*DeviceError, device string, err error) {
+		mu.Lock()
+		*errs = append(*errs, &DeviceError{Device: device, Err: err})
+		mu.Unlock()
 	}
 
-	for _, router := range config.Devices {
-		jnpr, err := junos.NewSession(router+":22", auth)
-		if err != nil {
-			return err
-		}
-		defer jnpr.Close()
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.Config.workerLimit())
+	for i, device := range devices {
+		i, device := i, device
+		g.Go(func() error {
+			driver, err := s.driverFor(device)
+			if err != nil {
+				recordErr(&phase1Errs, device.Name, err)
+				return err
+			}
 
-		log.Info("keychain update check lock", zap.String("router:", router))
-		if err := jnpr.CommitCheck(); err != nil {
-			if err.Error() == "expected element type <commit-results> but have <ok>" {
-				continue
+			cmds, err := driver.Render(s)
+			if err != nil {
+				log.Error("template error", zap.String("router", device.Name), zap.Error(err))
+				recordErr(&phase1Errs, device.Name, err)
+				s.recordOutcome(ctx, device.Name, OutcomeFailed, err.Error(), log)
+				return err
 			}
-			return err
-		}
+
+			log.Info("loading candidate config", zap.String("router", device.Name))
+			if err := driver.LoadCandidate(gctx, device, cmds); err != nil {
+				log.Error("load candidate failed", zap.String("router", device.Name), zap.Error(err))
+				commitFailuresTotal.WithLabelValues(device.Name, "load_candidate").Inc()
+				recordErr(&phase1Errs, device.Name, err)
+				s.recordOutcome(ctx, device.Name, OutcomeFailed, err.Error(), log)
+				return err
+			}
+
+			log.Info("confirmed commit", zap.String("router", device.Name), zap.Duration("timeout", timeout))
+			if err := driver.ConfirmedCommit(gctx, device, timeout, s.persistID(device)); err != nil {
+				log.Error("confirmed commit failed", zap.String("router", device.Name), zap.Error(err))
+				commitFailuresTotal.WithLabelValues(device.Name, "confirmed_commit").Inc()
+				recordErr(&phase1Errs, device.Name, err)
+				s.recordOutcome(ctx, device.Name, OutcomeFailed, err.Error(), log)
+				return err
+			}
+
+			mu.Lock()
+			confirmed[i] = true
+			mu.Unlock()
+			return nil
+		})
 	}
+	g.Wait()
 
-	for _, router := range config.Devices {
-		jnpr, err := junos.NewSession(router+":22", auth)
-		if err != nil {
-			return err
+	var confirmedDevices []Device
+	for i, ok := range confirmed {
+		if ok {
+			confirmedDevices = append(confirmedDevices, devices[i])
 		}
-		defer jnpr.Close()
+	}
+
+	if len(phase1Errs) > 0 {
+		return s.abortRollout(ctx, confirmedDevices, log, &MultiDeviceError{Errors: phase1Errs})
+	}
 
-		log.Info("keychain update config", zap.String("router:", router))
-		if err := jnpr.Config(cmds, "set", true); err != nil {
-			if err.Error() == "expected element type <commit-results> but have <ok>" {
-				committed = append(committed, router)
-				continue
+	var confirmErrs []*DeviceError
+	g2, gctx2 := errgroup.WithContext(ctx)
+	g2.SetLimit(s.Config.workerLimit())
+	for _, device := range confirmedDevices {
+		device := device
+		g2.Go(func() error {
+			driver, err := s.driverFor(device)
+			if err != nil {
+				recordErr(&confirmErrs, device.Name, err)
+				return err
 			}
-			if rollErr := rollbackCommitted(config, committed, log); rollErr != nil {
+
+			log.Info("confirming commit", zap.String("router", device.Name))
+			if err := driver.ConfirmCommit(gctx2, device, s.persistID(device)); err != nil {
+				log.Error("confirming commit failed, router will auto-revert", zap.String("router", device.Name), zap.Error(err))
+				commitFailuresTotal.WithLabelValues(device.Name, "confirm_commit").Inc()
+				recordErr(&confirmErrs, device.Name, err)
+				s.recordOutcome(ctx, device.Name, OutcomeFailed, err.Error(), log)
 				return err
 			}
-			return err
-		}
-		committed = append(committed, router)
+			keyRotationsTotal.WithLabelValues(device.Name, s.Config.Keychain).Inc()
+			lastSuccessTimestamp.WithLabelValues(device.Name).SetToCurrentTime()
+			s.recordOutcome(ctx, device.Name, OutcomeCommitted, "", log)
+			return nil
+		})
+	}
+	g2.Wait()
+
+	if len(confirmErrs) > 0 {
+		return fmt.Errorf("confirming commit failed: %w", &MultiDeviceError{Errors: confirmErrs})
 	}
 
 	return nil
 }
 
-func rollbackCommitted(config Config, routers []string, log *zap.Logger) error {
-	auth := &junos.AuthMethod{
-		Username:   config.User,
-		PrivateKey: config.Key,
+// abortRollout rolls back every device that already took a confirmed commit
+// in this rollout rather than waiting for its timer to expire, and returns
+// the original cause alongside any rollback failures. How far Rollback goes
+// depends on the driver: JunosDriver rolls back to the prior configuration,
+// while IOSXRDriver only discards the candidate datastore, so an IOS-XR
+// device that already took the confirmed commit still reverts only when its
+// confirm timer expires.
+func (s *KeyServer) abortRollout(ctx context.Context, confirmed []Device, log *zap.Logger, cause error) error {
+	if rollErr := s.rollbackCommitted(ctx, confirmed, log); rollErr != nil {
+		return fmt.Errorf("%w (rollback also failed: %v)", cause, rollErr)
 	}
+	return cause
+}
 
-	for _, router := range routers {
-		jnpr, err := junos.NewSession(router+":22", auth)
-		if err != nil {
-			return err
-		}
-		defer jnpr.Close()
+func (s *KeyServer) rollbackCommitted(ctx context.Context, devices []Device, log *zap.Logger) error {
+	var mu sync.Mutex
+	var errs []*DeviceError
 
-		log.Info("rollback config", zap.String("router:", router))
-		if err := jnpr.Rollback(1); err != nil {
-			if err.Error() == "expected element type <commit-results> but have <ok>" {
-				continue
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.Config.workerLimit())
+	for _, device := range devices {
+		device := device
+		g.Go(func() error {
+			driver, err := s.driverFor(device)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, &DeviceError{Device: device.Name, Err: err})
+				mu.Unlock()
+				return err
 			}
-			return err
-		}
+
+			log.Info("rollback config", zap.String("router", device.Name))
+			if err := driver.Rollback(gctx, device); err != nil {
+				commitFailuresTotal.WithLabelValues(device.Name, "rollback").Inc()
+				mu.Lock()
+				errs = append(errs, &DeviceError{Device: device.Name, Err: err})
+				mu.Unlock()
+				s.recordOutcome(ctx, device.Name, OutcomeFailed, "rollback failed: "+err.Error(), log)
+				return err
+			}
+			s.recordOutcome(ctx, device.Name, OutcomeRolledBack, "", log)
+			return nil
+		})
 	}
+	g.Wait()
 
+	if len(errs) > 0 {
+		return &MultiDeviceError{Errors: errs}
+	}
 	return nil
 }
 
@@ -399,17 +884,53 @@ func main() {
 	log, _ := NewLogger()
 	defer log.Sync()
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	config, err := readConfig("config.json", log)
 	if err != nil {
 		log.Error("config issue")
 	}
 
+	server, err := NewKeyServer(ctx, config)
+	if err != nil {
+		log.Error("keyserver init error", zap.Error(err))
+		return
+	}
+	defer func() {
+		if server.Store != nil {
+			if err := server.Store.Close(); err != nil {
+				log.Error("audit store close error", zap.Error(err))
+			}
+		}
+	}()
+
+	if err := server.Reconcile(ctx, log); err != nil {
+		log.Error("reconciliation error", zap.Error(err))
+	}
+
+	addr := config.API.Addr
+	if addr == "" {
+		addr = ":8799"
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	NewAdminAPI(server, log, config.API.Secret).Register(mux)
+
+	httpServer := &http.Server{Addr: addr, Handler: mux}
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		log.Info("listening on /metrics at :8799")
-		http.ListenAndServe(":8799", nil)
+		log.Info("listening", zap.String("addr", addr))
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error("http server error", zap.Error(err))
+		}
 	}()
 
-	server := NewKeyServer(config)
-	server.Run(log)
+	server.Run(ctx, log)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Error("http server shutdown error", zap.Error(err))
+	}
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Per-device metrics, so operators can alert on an individual router or a
+// drifted keychain instead of only on the fleet-wide lastResult gauge.
+var (
+	deviceUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keyserver_device_up",
+		Help: "Whether the last operation against a device succeeded (1) or not (0).",
+	}, []string{"device"})
+
+	deviceNTPOK = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keyserver_device_ntp_ok",
+		Help: "Whether a device's time source was confirmed as NTP on the last check.",
+	}, []string{"device"})
+
+	activeKeyID = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keyserver_active_key_id",
+		Help: "The currently active key ID on a device's keychain.",
+	}, []string{"device", "keychain"})
+
+	keyRotationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyserver_key_rotations_total",
+		Help: "Number of times a device's keychain has been rolled to a new key.",
+	}, []string{"device", "keychain"})
+
+	commitFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyserver_commit_failures_total",
+		Help: "Number of commit failures per device, labeled by failure reason.",
+	}, []string{"device", "reason"})
+
+	loopDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "keyserver_loop_duration_seconds",
+		Help: "Duration of a full KeyServer.loop run.",
+	})
+
+	lastSuccessTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keyserver_last_success_timestamp",
+		Help: "Unix timestamp of the last successful operation against a device.",
+	}, []string{"device"})
+)
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// RotationRecord is the audit trail of a single generated key rotation: the
+// schedule that was written before anything was pushed, and which devices it
+// targeted.
+type RotationRecord struct {
+	ID          int64
+	GeneratedAt time.Time
+	ActivateAt  time.Time
+	Keychain    string
+	CKN         []string
+	CAK         []string // encrypted at rest by the StateStore implementation
+	ROLL        []string
+	Devices     []string
+}
+
+// Outcome is the result of a rotation's commit on a single device.
+type Outcome string
+
+const (
+	OutcomeCommitted  Outcome = "committed"
+	OutcomeFailed     Outcome = "failed"
+	OutcomeRolledBack Outcome = "rolled_back"
+)
+
+// DeviceOutcome is one device's recorded result for a given rotation.
+type DeviceOutcome struct {
+	RotationID int64
+	Device     string
+	Status     Outcome
+	Detail     string
+	RecordedAt time.Time
+}
+
+// StateStore persists the audit trail of key rotations: what was generated,
+// when it was meant to activate, and how each device's commit went. The
+// default implementation is backed by SQLite; Postgres is a drop-in
+// replacement via NewPostgresStore since both share the same schema and
+// queries.
+type StateStore interface {
+	// RecordRotation persists a newly generated schedule before it's pushed
+	// to any device, so a crash mid-rollout still leaves an audit trail of
+	// what was intended.
+	RecordRotation(ctx context.Context, rotation RotationRecord) (int64, error)
+
+	// RecordOutcome records a single device's result for rotationID.
+	RecordOutcome(ctx context.Context, outcome DeviceOutcome) error
+
+	// Rotations returns the most recent rotations, newest first, along with
+	// their recorded per-device outcomes.
+	Rotations(ctx context.Context, limit int) ([]RotationRecord, map[int64][]DeviceOutcome, error)
+
+	// Prune deletes rotations (and their outcomes) generated before the
+	// given time, per the configured retention policy.
+	Prune(ctx context.Context, before time.Time) error
+
+	Close() error
+}
+
+// sqlStore implements StateStore over database/sql. driver selects the
+// placeholder style ("postgres" uses $1, $2, ...; everything else uses ?).
+type sqlStore struct {
+	db     *sql.DB
+	driver string
+
+	Encryptor StateEncryptor
+}
+
+// NewSQLiteStore opens (and migrates, if necessary) a SQLite-backed
+// StateStore at path. CAK values are encrypted with encryptor before being
+// written.
+func NewSQLiteStore(path string, encryptor StateEncryptor) (StateStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening sqlite store: %w", err)
+	}
+	store := &sqlStore{db: db, driver: "sqlite", Encryptor: encryptor}
+	if err := store.migrate(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// NewPostgresStore opens (and migrates, if necessary) a Postgres-backed
+// StateStore at dsn. CAK values are encrypted with encryptor before being
+// written.
+func NewPostgresStore(dsn string, encryptor StateEncryptor) (StateStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening postgres store: %w", err)
+	}
+	store := &sqlStore{db: db, driver: "postgres", Encryptor: encryptor}
+	if err := store.migrate(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *sqlStore) migrate() error {
+	idColumn := "id INTEGER PRIMARY KEY AUTOINCREMENT"
+	if s.driver == "postgres" {
+		idColumn = "id SERIAL PRIMARY KEY"
+	}
+
+	_, err := s.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS rotations (
+		%s,
+		generated_at TIMESTAMP NOT NULL,
+		activate_at TIMESTAMP NOT NULL,
+		keychain TEXT NOT NULL,
+		ckn TEXT NOT NULL,
+		cak TEXT NOT NULL,
+		roll TEXT NOT NULL,
+		devices TEXT NOT NULL
+	)`, idColumn))
+	if err != nil {
+		return fmt.Errorf("migrating rotations table: %w", err)
+	}
+
+	_, err = s.db.Exec(`CREATE TABLE IF NOT EXISTS device_outcomes (
+		rotation_id INTEGER NOT NULL,
+		device TEXT NOT NULL,
+		status TEXT NOT NULL,
+		detail TEXT,
+		recorded_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("migrating device_outcomes table: %w", err)
+	}
+
+	return nil
+}
+
+// rebind rewrites ?-style placeholders into $1, $2, ... for drivers (like
+// postgres) that don't accept ?.
+func (s *sqlStore) rebind(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) RecordRotation(ctx context.Context, rotation RotationRecord) (int64, error) {
+	encryptedCAK := make([]string, len(rotation.CAK))
+	for i, cak := range rotation.CAK {
+		ciphertext, err := s.Encryptor.Encrypt(ctx, cak)
+		if err != nil {
+			return 0, fmt.Errorf("encrypting CAK: %w", err)
+		}
+		encryptedCAK[i] = ciphertext
+	}
+
+	ckn, err := json.Marshal(rotation.CKN)
+	if err != nil {
+		return 0, err
+	}
+	cak, err := json.Marshal(encryptedCAK)
+	if err != nil {
+		return 0, err
+	}
+	roll, err := json.Marshal(rotation.ROLL)
+	if err != nil {
+		return 0, err
+	}
+	devices, err := json.Marshal(rotation.Devices)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `INSERT INTO rotations (generated_at, activate_at, keychain, ckn, cak, roll, devices) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	args := []interface{}{rotation.GeneratedAt, rotation.ActivateAt, rotation.Keychain, string(ckn), string(cak), string(roll), string(devices)}
+
+	// lib/pq doesn't support LastInsertId, so postgres returns the new id
+	// from the INSERT itself.
+	if s.driver == "postgres" {
+		var id int64
+		if err := s.db.QueryRowContext(ctx, s.rebind(query+` RETURNING id`), args...).Scan(&id); err != nil {
+			return 0, fmt.Errorf("recording rotation: %w", err)
+		}
+		return id, nil
+	}
+
+	result, err := s.db.ExecContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return 0, fmt.Errorf("recording rotation: %w", err)
+	}
+
+	return result.LastInsertId()
+}
+
+func (s *sqlStore) RecordOutcome(ctx context.Context, outcome DeviceOutcome) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO device_outcomes (rotation_id, device, status, detail, recorded_at) VALUES (?, ?, ?, ?, ?)`),
+		outcome.RotationID, outcome.Device, string(outcome.Status), outcome.Detail, outcome.RecordedAt)
+	if err != nil {
+		return fmt.Errorf("recording outcome: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) Rotations(ctx context.Context, limit int) ([]RotationRecord, map[int64][]DeviceOutcome, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT id, generated_at, activate_at, keychain, ckn, cak, roll, devices FROM rotations ORDER BY id DESC LIMIT ?`), limit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing rotations: %w", err)
+	}
+	defer rows.Close()
+
+	var rotations []RotationRecord
+	for rows.Next() {
+		var r RotationRecord
+		var ckn, cak, roll, devices string
+		if err := rows.Scan(&r.ID, &r.GeneratedAt, &r.ActivateAt, &r.Keychain, &ckn, &cak, &roll, &devices); err != nil {
+			return nil, nil, err
+		}
+
+		if err := json.Unmarshal([]byte(ckn), &r.CKN); err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal([]byte(roll), &r.ROLL); err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal([]byte(devices), &r.Devices); err != nil {
+			return nil, nil, err
+		}
+
+		var encryptedCAK []string
+		if err := json.Unmarshal([]byte(cak), &encryptedCAK); err != nil {
+			return nil, nil, err
+		}
+		decrypted := make([]string, len(encryptedCAK))
+		for i, ciphertext := range encryptedCAK {
+			plaintext, err := s.Encryptor.Decrypt(ctx, ciphertext)
+			if err != nil {
+				// Leave r.CAK unset for this rotation rather than failing the
+				// whole listing: one rotation encrypted under a key this
+				// Encryptor can no longer produce (e.g. a passphrase change)
+				// shouldn't take down /audit or every other rotation's
+				// status. Callers that need CAK to resume a rotation (see
+				// KeyServer.pendingRotation) detect this via len(r.CAK) != len(r.CKN).
+				decrypted = nil
+				break
+			}
+			decrypted[i] = plaintext
+		}
+		r.CAK = decrypted
+
+		rotations = append(rotations, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	outcomes := make(map[int64][]DeviceOutcome)
+	for _, r := range rotations {
+		outcomeRows, err := s.db.QueryContext(ctx, s.rebind(`SELECT rotation_id, device, status, detail, recorded_at FROM device_outcomes WHERE rotation_id = ? ORDER BY recorded_at ASC`), r.ID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("listing outcomes for rotation %d: %w", r.ID, err)
+		}
+
+		for outcomeRows.Next() {
+			var o DeviceOutcome
+			var status string
+			if err := outcomeRows.Scan(&o.RotationID, &o.Device, &status, &o.Detail, &o.RecordedAt); err != nil {
+				outcomeRows.Close()
+				return nil, nil, err
+			}
+			o.Status = Outcome(status)
+			outcomes[r.ID] = append(outcomes[r.ID], o)
+		}
+		if err := outcomeRows.Err(); err != nil {
+			outcomeRows.Close()
+			return nil, nil, err
+		}
+		outcomeRows.Close()
+	}
+
+	return rotations, outcomes, nil
+}
+
+func (s *sqlStore) Prune(ctx context.Context, before time.Time) error {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT id FROM rotations WHERE generated_at < ?`), before)
+	if err != nil {
+		return fmt.Errorf("listing rotations to prune: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if _, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM device_outcomes WHERE rotation_id = ?`), id); err != nil {
+			return fmt.Errorf("pruning outcomes for rotation %d: %w", id, err)
+		}
+		if _, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM rotations WHERE id = ?`), id); err != nil {
+			return fmt.Errorf("pruning rotation %d: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+var _ StateStore = (*sqlStore)(nil)